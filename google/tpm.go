@@ -11,6 +11,11 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
 	"sync"
 
 	"github.com/google/go-tpm/tpm2"
@@ -19,26 +24,289 @@ import (
 	"golang.org/x/oauth2/jws"
 )
 
-// TpmTokenConfig parameters to start Credential based off of TPM RSA Private Key.
+// googleTokenURL is the default endpoint used to exchange a signed JWT
+// assertion for a Google OAuth2 access token.
+const googleTokenURL = "https://oauth2.googleapis.com/token"
+
+// defaultEarlyTokenExpiry is how long before a cached token's expiry the
+// TPM token sources proactively re-sign and refresh it, unless a config
+// overrides it.
+const defaultEarlyTokenExpiry = 60 * time.Second
+
+// defaultHTTPTimeout bounds the calls these sources make to Google's token
+// endpoints, so a slow or hung endpoint can't stall a Token() call forever.
+const defaultHTTPTimeout = 30 * time.Second
+
+// httpClientOrDefault returns c, or a client with defaultHTTPTimeout if c
+// is nil, so callers that don't set an HTTPClient still get a bounded call.
+func httpClientOrDefault(c *http.Client) *http.Client {
+	if c != nil {
+		return c
+	}
+	return &http.Client{Timeout: defaultHTTPTimeout}
+}
+
+// postForm POSTs v to rawURL as an application/x-www-form-urlencoded body
+// using client, mirroring http.PostForm but honoring a caller-supplied
+// *http.Client instead of http.DefaultClient.
+func postForm(client *http.Client, rawURL string, v url.Values) (*http.Response, error) {
+	req, err := http.NewRequest("POST", rawURL, strings.NewReader(v.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return client.Do(req)
+}
+
+// tpmCachingTokenSource wraps an oauth2.ReuseTokenSourceWithExpiry around a
+// raw TPM-backed TokenSource so repeated Token() calls reuse the last
+// signed token until it is close to expiry, and exposes a Close method that
+// releases the TPM device handle the raw source kept open across refreshes.
+//
+// All constructors in this package (TpmTokenSource, TpmJWTAccessTokenSource,
+// TpmIDTokenSource, TpmWorkloadIdentitySource) return a *tpmCachingTokenSource,
+// so the underlying TPM is opened at most once and a Sign operation is only
+// performed when the cached token is about to expire. It is safe for
+// concurrent use.
+type tpmCachingTokenSource struct {
+	oauth2.TokenSource
+	closer io.Closer
+}
+
+// Close releases the TPM device handle kept open by the wrapped source.
+func (s *tpmCachingTokenSource) Close() error {
+	return s.closer.Close()
+}
+
+func newTpmCachingTokenSource(raw oauth2.TokenSource, closer io.Closer, earlyExpiry time.Duration) oauth2.TokenSource {
+	if earlyExpiry == 0 {
+		earlyExpiry = defaultEarlyTokenExpiry
+	}
+	return &tpmCachingTokenSource{
+		TokenSource: oauth2.ReuseTokenSourceWithExpiry(nil, raw, earlyExpiry),
+		closer:      closer,
+	}
+}
+
+// openTPMLocked lazily opens the TPM device at tpmPath into *rwc if it
+// isn't already open. Callers must hold the source's refreshMutex.
+func openTPMLocked(tpmPath string, rwc *io.ReadWriteCloser) error {
+	if *rwc != nil {
+		return nil
+	}
+	opened, err := tpm2.OpenTPM(tpmPath)
+	if err != nil {
+		return fmt.Errorf("google: Unable to Open TPM: %v", err)
+	}
+	*rwc = opened
+	return nil
+}
+
+// closeTPMLocked closes and clears *rwc if it is open. Callers must hold
+// the source's refreshMutex.
+func closeTPMLocked(rwc *io.ReadWriteCloser) error {
+	if *rwc == nil {
+		return nil
+	}
+	err := (*rwc).Close()
+	*rwc = nil
+	return err
+}
+
+// TpmTokenConfig parameters to start Credential based off of a TPM RSA or
+// ECC (P-256) Private Key.
 type TpmTokenConfig struct {
+	Tpm, Email string
+	TpmHandle  uint32
+	KeyId      string
+
+	// Scopes is the list of requested OAuth2 scopes (e.g.
+	// "https://www.googleapis.com/auth/cloud-platform"). The TPM-signed
+	// assertion is exchanged at TokenURL for an access token scoped to
+	// these values.
+	Scopes []string
+
+	// TokenURL is the Google OAuth2 token endpoint used for the JWT
+	// bearer token exchange. If empty, the default
+	// "https://oauth2.googleapis.com/token" is used.
+	TokenURL string
+
+	// EarlyTokenExpiry is how long before expiry a cached token is
+	// re-signed and refreshed. Defaults to 60s.
+	EarlyTokenExpiry time.Duration
+
+	// HTTPClient is used for the JWT bearer token exchange. If nil, a
+	// client with a default 30s timeout is used.
+	HTTPClient *http.Client
+}
+
+type tpmTokenSource struct {
+	refreshMutex *sync.Mutex
+	tpm, email   string
+	scopes       []string
+	tokenURL     string
+	httpClient   *http.Client
+
+	rwc       io.ReadWriteCloser
+	tpmHandle tpmutil.Handle
+	keyId     string
+}
+
+// TpmTokenSource returns a TokenSource for a ServiceAccount where
+// the privateKey is sealed within a Trusted Platform Module (TPM).
+// The TokenSource uses the TPM to sign a JWT assertion and exchanges it
+// with the Google OAuth2 token endpoint for an ordinary scoped access
+// token, exactly as golang.org/x/oauth2/jwt.Config.TokenSource does for
+// on-disk private keys.
+//
+// This TpmTokenSource will only work on platforms where the PrivateKey for the Service
+// Account is already loaded on the TPM previously and available via Persistent Handle.
+//
+// https://developers.google.com/identity/protocols/OAuth2ServiceAccount#jwt-auth
+// https://github.com/tpm2-software/tpm2-tools/wiki/Duplicating-Objects
+//
+//  Tpm (string): The device Handle for the TPM (eg. "/dev/tpm0")
+//  Email (string): The service account to get the token for.
+//  Scopes ([]string): The list of oauth2 scopes to request for the access token.
+//  TokenURL (string): (optional) The token endpoint to exchange the signed
+//      assertion at. Defaults to https://oauth2.googleapis.com/token.
+//  TpmHandle (uint32): The persistent Handle representing the sealed keypair.
+//      This must be set prior to using this library.
+//  KeyId (string): (optional) The private KeyID for the service account key saved to the TPM.
+//      Find the keyId associated with the service account by running:
+//      `gcloud iam service-accounts keys list --iam-account=<email>``
+//
+// The returned TokenSource caches and reuses the signed token until it is
+// close to expiry, and keeps the TPM device handle open across refreshes.
+// Call Close() on the returned source (or type-assert to io.Closer) to
+// release it once it is no longer needed.
+func TpmTokenSource(tokenConfig TpmTokenConfig) (oauth2.TokenSource, error) {
+
+	if tokenConfig.Tpm == "" || tokenConfig.TpmHandle == 0 || tokenConfig.Email == "" || len(tokenConfig.Scopes) == 0 {
+		return nil, fmt.Errorf("salrashid123/x/oauth2/google: TPMTokenConfig.Tpm, TPMTokenConfig.TpmHandle, TPMTokenConfig.Email and Scopes cannot be nil")
+	}
+
+	tokenURL := tokenConfig.TokenURL
+	if tokenURL == "" {
+		tokenURL = googleTokenURL
+	}
+
+	raw := &tpmTokenSource{
+		refreshMutex: &sync.Mutex{},
+		email:        tokenConfig.Email,
+		scopes:       tokenConfig.Scopes,
+		tokenURL:     tokenURL,
+		httpClient:   httpClientOrDefault(tokenConfig.HTTPClient),
+		tpm:          tokenConfig.Tpm,
+		tpmHandle:    tpmutil.Handle(tokenConfig.TpmHandle),
+		keyId:        tokenConfig.KeyId,
+	}
+
+	return newTpmCachingTokenSource(raw, raw, tokenConfig.EarlyTokenExpiry), nil
+}
+
+// Close releases the TPM device handle kept open across token refreshes.
+func (ts *tpmTokenSource) Close() error {
+	ts.refreshMutex.Lock()
+	defer ts.refreshMutex.Unlock()
+	return closeTPMLocked(&ts.rwc)
+}
+
+// signAssertionLocked opens the TPM (if needed) and signs the assertion
+// under refreshMutex, then releases the lock before returning so the
+// network round-trip that follows doesn't block other concurrent callers.
+func (ts *tpmTokenSource) signAssertionLocked(iat, exp time.Time) (string, error) {
+	ts.refreshMutex.Lock()
+	defer ts.refreshMutex.Unlock()
+
+	if err := openTPMLocked(ts.tpm, &ts.rwc); err != nil {
+		return "", err
+	}
+
+	return signTpmJWT(ts.rwc, ts.tpmHandle, ts.keyId, &jws.ClaimSet{
+		Iss: ts.email,
+		Aud: ts.tokenURL,
+		Iat: iat.Unix(),
+		Exp: exp.Unix(),
+		PrivateClaims: map[string]interface{}{
+			"scope": strings.Join(ts.scopes, " "),
+		},
+	})
+}
+
+func (ts *tpmTokenSource) Token() (*oauth2.Token, error) {
+	iat := time.Now()
+	exp := iat.Add(time.Hour)
+
+	assertion, err := ts.signAssertionLocked(iat, exp)
+	if err != nil {
+		return nil, fmt.Errorf("google: unable to sign TPM JWT assertion: %v", err)
+	}
+
+	v := url.Values{}
+	v.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+	v.Set("assertion", assertion)
+
+	resp, err := postForm(ts.httpClient, ts.tokenURL, v)
+	if err != nil {
+		return nil, fmt.Errorf("google: unable to exchange TPM JWT assertion for a token: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("google: unable to read token endpoint response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("google: token endpoint returned %v: %s", resp.StatusCode, body)
+	}
+
+	var tokenRes struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &tokenRes); err != nil {
+		return nil, fmt.Errorf("google: unable to unmarshal token endpoint response: %v", err)
+	}
+
+	return &oauth2.Token{
+		AccessToken: tokenRes.AccessToken,
+		TokenType:   tokenRes.TokenType,
+		Expiry:      iat.Add(time.Duration(tokenRes.ExpiresIn) * time.Second),
+	}, nil
+}
+
+// TpmJWTAccessTokenConfig parameters to start a self-signed JWT Credential
+// based off of a TPM RSA or ECC (P-256) Private Key.
+type TpmJWTAccessTokenConfig struct {
 	Tpm, Email, Audience string
 	TpmHandle            uint32
 	KeyId                string
+
+	// EarlyTokenExpiry is how long before expiry a cached token is
+	// re-signed and refreshed. Defaults to 60s.
+	EarlyTokenExpiry time.Duration
 }
 
-type tpmTokenSource struct {
+type tpmJWTAccessTokenSource struct {
 	refreshMutex         *sync.Mutex
 	tpm, email, audience string
 
+	rwc       io.ReadWriteCloser
 	tpmHandle tpmutil.Handle
 	keyId     string
 }
 
-// TpmTokenSource returns a TokenSource for a ServiceAccount where
-// the privateKey is sealed within a Trusted Platform Module (TPM)
-// The TokenSource uses the TPM to sign a JWT representing an AccessTokenCredential.
+// TpmJWTAccessTokenSource returns a TokenSource for a ServiceAccount where
+// the privateKey is sealed within a Trusted Platform Module (TPM).
+// The TokenSource uses the TPM to sign a self-signed JWT representing an
+// AccessTokenCredential. Unlike TpmTokenSource, the JWT is never exchanged
+// with Google's token endpoint: it is presented as-is as a bearer token,
+// which only works against services that accept self-signed JWTs for the
+// given Audience.
 //
-// This TpmTokenSource will only work on platforms where the PrivateKey for the Service
+// This TpmJWTAccessTokenSource will only work on platforms where the PrivateKey for the Service
 // Account is already loaded on the TPM previously and available via Persistent Handle.
 //
 // https://developers.google.com/identity/protocols/OAuth2ServiceAccount#jwt-auth
@@ -58,49 +326,47 @@ type tpmTokenSource struct {
 //      Find the keyId associated with the service account by running:
 //      `gcloud iam service-accounts keys list --iam-account=<email>``
 //
-func TpmTokenSource(tokenConfig TpmTokenConfig) (oauth2.TokenSource, error) {
+// The returned TokenSource caches and reuses the signed token until it is
+// close to expiry, and keeps the TPM device handle open across refreshes.
+// Call Close() on the returned source (or type-assert to io.Closer) to
+// release it once it is no longer needed.
+func TpmJWTAccessTokenSource(tokenConfig TpmJWTAccessTokenConfig) (oauth2.TokenSource, error) {
 
 	if tokenConfig.Tpm == "" || tokenConfig.TpmHandle == 0 || tokenConfig.Email == "" || tokenConfig.Audience == "" {
-		return nil, fmt.Errorf("salrashid123/x/oauth2/google: TPMTokenConfig.Tpm, TPMTokenConfig.TpmHandle, TPMTokenConfig.Email and Audience and cannot be nil")
+		return nil, fmt.Errorf("salrashid123/x/oauth2/google: TpmJWTAccessTokenConfig.Tpm, TpmJWTAccessTokenConfig.TpmHandle, TpmJWTAccessTokenConfig.Email and Audience cannot be nil")
 	}
 
-	return &tpmTokenSource{
+	raw := &tpmJWTAccessTokenSource{
 		refreshMutex: &sync.Mutex{},
 		email:        tokenConfig.Email,
 		audience:     tokenConfig.Audience,
 		tpm:          tokenConfig.Tpm,
 		tpmHandle:    tpmutil.Handle(tokenConfig.TpmHandle),
 		keyId:        tokenConfig.KeyId,
-	}, nil
+	}
 
+	return newTpmCachingTokenSource(raw, raw, tokenConfig.EarlyTokenExpiry), nil
 }
 
-func (ts *tpmTokenSource) Token() (*oauth2.Token, error) {
+// Close releases the TPM device handle kept open across token refreshes.
+func (ts *tpmJWTAccessTokenSource) Close() error {
 	ts.refreshMutex.Lock()
 	defer ts.refreshMutex.Unlock()
+	return closeTPMLocked(&ts.rwc)
+}
 
-	rwc, err := tpm2.OpenTPM(ts.tpm)
-	if err != nil {
-		return nil, fmt.Errorf("google: Unable to Open TPM: %v", err)
+func (ts *tpmJWTAccessTokenSource) Token() (*oauth2.Token, error) {
+	ts.refreshMutex.Lock()
+	defer ts.refreshMutex.Unlock()
+
+	if err := openTPMLocked(ts.tpm, &ts.rwc); err != nil {
+		return nil, err
 	}
-	defer func() {
-		if err := rwc.Close(); err != nil {
-			fmt.Errorf("google: Unable to close TPM: %v", err)
-		}
-	}()
 
 	iat := time.Now()
 	exp := iat.Add(time.Hour)
 
-	hdr, err := json.Marshal(&jws.Header{
-		Algorithm: "RS256",
-		Typ:       "JWT",
-		KeyID:     string(ts.keyId),
-	})
-	if err != nil {
-		return nil, fmt.Errorf("google: Unable to marshal TPM JWT Header: %v", err)
-	}
-	cs, err := json.Marshal(&jws.ClaimSet{
+	msg, err := signTpmJWT(ts.rwc, ts.tpmHandle, ts.keyId, &jws.ClaimSet{
 		Iss: ts.email,
 		Sub: ts.email,
 		Aud: ts.audience,
@@ -108,21 +374,77 @@ func (ts *tpmTokenSource) Token() (*oauth2.Token, error) {
 		Exp: exp.Unix(),
 	})
 	if err != nil {
-		return nil, fmt.Errorf("google: Unable to marshal TPM JWT ClaimSet: %v", err)
+		return nil, fmt.Errorf("google: unable to sign TPM JWT: %v", err)
 	}
 
-	j := base64.URLEncoding.EncodeToString([]byte(hdr)) + "." + base64.URLEncoding.EncodeToString([]byte(cs))
+	return &oauth2.Token{AccessToken: msg, TokenType: "Bearer", Expiry: exp}, nil
+}
 
-	digest := sha256.Sum256([]byte(j))
-	sig, err := tpm2.Sign(rwc, ts.tpmHandle, "", digest[:], &tpm2.SigScheme{
-		Alg:  tpm2.AlgRSASSA,
-		Hash: tpm2.AlgSHA256,
+// signTpmJWT signs the JWS header+claims for the RSA or ECC (P-256) key
+// held at tpmHandle on the already-open rwc, and returns the compact
+// "header.claims.sig" serialization. The signing algorithm is determined
+// by reading the public area of tpmHandle, so callers never need to know
+// whether the underlying key is RSA or ECC. Callers own rwc's lifecycle.
+func signTpmJWT(rwc io.ReadWriteCloser, tpmHandle tpmutil.Handle, keyId string, cs *jws.ClaimSet) (string, error) {
+	pub, _, _, err := tpm2.ReadPublic(rwc, tpmHandle)
+	if err != nil {
+		return "", fmt.Errorf("google: Unable to read TPM public area: %v", err)
+	}
+
+	hdr, err := json.Marshal(&jws.Header{
+		Algorithm: jwsAlgorithm(pub.Type),
+		Typ:       "JWT",
+		KeyID:     keyId,
 	})
 	if err != nil {
-		return nil, fmt.Errorf("google: Unable to Sign wit TPM: %v", err)
+		return "", fmt.Errorf("google: Unable to marshal TPM JWT Header: %v", err)
+	}
+	csj, err := json.Marshal(cs)
+	if err != nil {
+		return "", fmt.Errorf("google: Unable to marshal TPM JWT ClaimSet: %v", err)
 	}
 
-	msg := j + "." + base64.RawStdEncoding.EncodeToString([]byte(sig.RSA.Signature))
+	j := base64.RawURLEncoding.EncodeToString([]byte(hdr)) + "." + base64.RawURLEncoding.EncodeToString([]byte(csj))
 
-	return &oauth2.Token{AccessToken: msg, TokenType: "Bearer", Expiry: exp}, nil
-}
\ No newline at end of file
+	digest := sha256.Sum256([]byte(j))
+
+	var rawSig []byte
+	if pub.Type == tpm2.AlgECC {
+		sig, err := tpm2.Sign(rwc, tpmHandle, "", digest[:], &tpm2.SigScheme{
+			Alg:  tpm2.AlgECDSA,
+			Hash: tpm2.AlgSHA256,
+		})
+		if err != nil {
+			return "", fmt.Errorf("google: Unable to Sign with TPM: %v", err)
+		}
+		rawSig = append(leftPad32(sig.ECC.R.Bytes()), leftPad32(sig.ECC.S.Bytes())...)
+	} else {
+		sig, err := tpm2.Sign(rwc, tpmHandle, "", digest[:], &tpm2.SigScheme{
+			Alg:  tpm2.AlgRSASSA,
+			Hash: tpm2.AlgSHA256,
+		})
+		if err != nil {
+			return "", fmt.Errorf("google: Unable to Sign with TPM: %v", err)
+		}
+		rawSig = []byte(sig.RSA.Signature)
+	}
+
+	return j + "." + base64.RawURLEncoding.EncodeToString(rawSig), nil
+}
+
+// leftPad32 pads b with leading zero bytes to the fixed 32-byte width
+// required for an ECDSA P-256 (R,S) component in a JWS signature.
+func leftPad32(b []byte) []byte {
+	out := make([]byte, 32)
+	copy(out[32-len(b):], b)
+	return out
+}
+
+// jwsAlgorithm returns the JWS "alg" header value for a TPM public key of
+// the given type: "ES256" for ECC (P-256) keys, "RS256" otherwise.
+func jwsAlgorithm(keyType tpm2.Algorithm) string {
+	if keyType == tpm2.AlgECC {
+		return "ES256"
+	}
+	return "RS256"
+}
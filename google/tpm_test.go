@@ -0,0 +1,197 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package google
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-tpm/tpm2"
+	"golang.org/x/oauth2"
+)
+
+func TestJwsAlgorithm(t *testing.T) {
+	if got := jwsAlgorithm(tpm2.AlgECC); got != "ES256" {
+		t.Errorf("jwsAlgorithm(AlgECC) = %q, want ES256", got)
+	}
+	if got := jwsAlgorithm(tpm2.AlgRSA); got != "RS256" {
+		t.Errorf("jwsAlgorithm(AlgRSA) = %q, want RS256", got)
+	}
+}
+
+func TestLeftPad32(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+	}{
+		{"empty", nil},
+		{"short", []byte{0x01, 0x02}},
+		{"exactly32", make([]byte, 32)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := leftPad32(tt.in)
+			if len(out) != 32 {
+				t.Fatalf("leftPad32(%v) has length %d, want 32", tt.in, len(out))
+			}
+			for i, b := range tt.in {
+				if out[32-len(tt.in)+i] != b {
+					t.Errorf("leftPad32(%v)[%d] = %#x, want %#x", tt.in, 32-len(tt.in)+i, out[32-len(tt.in)+i], b)
+				}
+			}
+		})
+	}
+}
+
+// fakeTokenSource is an oauth2.TokenSource whose Token() returns the next
+// entry from tokens on each call, and counts how many times it was invoked.
+type fakeTokenSource struct {
+	mu     sync.Mutex
+	tokens []*oauth2.Token
+	calls  int
+}
+
+func (f *fakeTokenSource) Token() (*oauth2.Token, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.calls >= len(f.tokens) {
+		return nil, errors.New("fakeTokenSource: exhausted")
+	}
+	tok := f.tokens[f.calls]
+	f.calls++
+	return tok, nil
+}
+
+// fakeCloser is an io.ReadWriteCloser stand-in for a TPM device handle;
+// Read/Write are unused by these tests and only exist to satisfy the
+// interface.
+type fakeCloser struct {
+	closed int
+}
+
+func (f *fakeCloser) Read(p []byte) (int, error)  { return 0, io.EOF }
+func (f *fakeCloser) Write(p []byte) (int, error) { return len(p), nil }
+
+func (f *fakeCloser) Close() error {
+	f.closed++
+	return nil
+}
+
+func TestTpmCachingTokenSourceReusesUntilNearExpiry(t *testing.T) {
+	fake := &fakeTokenSource{
+		tokens: []*oauth2.Token{
+			{AccessToken: "first", Expiry: time.Now().Add(time.Hour)},
+			{AccessToken: "second", Expiry: time.Now().Add(time.Hour)},
+		},
+	}
+
+	src := newTpmCachingTokenSource(fake, &fakeCloser{}, time.Second)
+
+	for i := 0; i < 3; i++ {
+		tok, err := src.Token()
+		if err != nil {
+			t.Fatalf("Token() error = %v", err)
+		}
+		if tok.AccessToken != "first" {
+			t.Errorf("Token() = %q, want %q to be cached", tok.AccessToken, "first")
+		}
+	}
+	if fake.calls != 1 {
+		t.Errorf("underlying source called %d times, want 1", fake.calls)
+	}
+}
+
+func TestTpmCachingTokenSourceRefreshesAfterExpiry(t *testing.T) {
+	const earlyExpiry = 50 * time.Millisecond
+	fake := &fakeTokenSource{
+		tokens: []*oauth2.Token{
+			{AccessToken: "first", Expiry: time.Now().Add(100 * time.Millisecond)},
+			{AccessToken: "second", Expiry: time.Now().Add(time.Hour)},
+		},
+	}
+
+	src := newTpmCachingTokenSource(fake, &fakeCloser{}, earlyExpiry)
+
+	// First call populates the cache: the first token still has more than
+	// earlyExpiry left, so it is returned as-is.
+	tok, err := src.Token()
+	if err != nil {
+		t.Fatalf("Token() error = %v", err)
+	}
+	if tok.AccessToken != "first" {
+		t.Errorf("Token() = %q, want %q on first call", tok.AccessToken, "first")
+	}
+	if fake.calls != 1 {
+		t.Errorf("underlying source called %d times, want 1", fake.calls)
+	}
+
+	// Wait until the cached token is within earlyExpiry of its expiry, then
+	// the next call must observe that and refresh.
+	time.Sleep(70 * time.Millisecond)
+
+	tok, err = src.Token()
+	if err != nil {
+		t.Fatalf("Token() error = %v", err)
+	}
+	if tok.AccessToken != "second" {
+		t.Errorf("Token() = %q, want %q once within earlyExpiry of the first token's expiry", tok.AccessToken, "second")
+	}
+	if fake.calls != 2 {
+		t.Errorf("underlying source called %d times, want 2", fake.calls)
+	}
+}
+
+func TestTpmCachingTokenSourceClose(t *testing.T) {
+	fake := &fakeTokenSource{tokens: []*oauth2.Token{{AccessToken: "tok", Expiry: time.Now().Add(time.Hour)}}}
+	closer := &fakeCloser{}
+
+	src := newTpmCachingTokenSource(fake, closer, 0)
+
+	c, ok := src.(io.Closer)
+	if !ok {
+		t.Fatalf("newTpmCachingTokenSource result does not implement io.Closer")
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if closer.closed != 1 {
+		t.Errorf("closer.Close() called %d times, want 1", closer.closed)
+	}
+}
+
+func TestOpenTPMLockedNoopWhenAlreadyOpen(t *testing.T) {
+	var rwc io.ReadWriteCloser = &fakeCloser{}
+	if err := openTPMLocked("/dev/tpm0", &rwc); err != nil {
+		t.Fatalf("openTPMLocked() error = %v, want nil when rwc already set", err)
+	}
+	if rwc == nil {
+		t.Fatalf("openTPMLocked() cleared an already-open rwc")
+	}
+}
+
+func TestCloseTPMLockedClosesAndClears(t *testing.T) {
+	fc := &fakeCloser{}
+	var rwc io.ReadWriteCloser = fc
+	if err := closeTPMLocked(&rwc); err != nil {
+		t.Fatalf("closeTPMLocked() error = %v", err)
+	}
+	if fc.closed != 1 {
+		t.Errorf("underlying Close() called %d times, want 1", fc.closed)
+	}
+	if rwc != nil {
+		t.Errorf("closeTPMLocked() did not clear rwc")
+	}
+
+	// Calling again on an already-nil rwc must be a no-op, not a panic.
+	if err := closeTPMLocked(&rwc); err != nil {
+		t.Fatalf("closeTPMLocked() on nil rwc error = %v", err)
+	}
+	if fc.closed != 1 {
+		t.Errorf("underlying Close() called again on a nil rwc, count = %d", fc.closed)
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package google
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/google/go-tpm/tpmutil"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/jws"
+)
+
+// TpmIDTokenConfig parameters used to mint a Google OIDC ID token signed by
+// a TPM-sealed private key.
+type TpmIDTokenConfig struct {
+	Tpm, Email string
+	TpmHandle  uint32
+	KeyId      string
+
+	// TargetAudience is the audience the ID token is issued for, e.g. an
+	// IAP client ID or a Cloud Run / Cloud Functions URL.
+	TargetAudience string
+
+	// EarlyTokenExpiry is how long before expiry a cached token is
+	// re-signed and refreshed. Defaults to 60s.
+	EarlyTokenExpiry time.Duration
+
+	// HTTPClient is used for the JWT bearer token exchange. If nil, a
+	// client with a default 30s timeout is used.
+	HTTPClient *http.Client
+}
+
+type tpmIDTokenSource struct {
+	refreshMutex               *sync.Mutex
+	tpm, email, targetAudience string
+	httpClient                 *http.Client
+
+	rwc       io.ReadWriteCloser
+	tpmHandle tpmutil.Handle
+	keyId     string
+}
+
+// TpmIDTokenSource returns a TokenSource for a ServiceAccount that produces
+// Google-signed OIDC ID tokens, e.g. for authenticating to IAP, Cloud Run
+// or Cloud Functions, while keeping the service account's private key
+// sealed within a Trusted Platform Module (TPM). It is the TPM-backed
+// analogue of golang.org/x/oauth2/google/idtoken.NewTokenSource for keys
+// that never leave the TPM.
+//
+// This TpmIDTokenSource will only work on platforms where the PrivateKey for the Service
+// Account is already loaded on the TPM previously and available via Persistent Handle.
+//
+// https://developers.google.com/identity/protocols/OAuth2ServiceAccount#jwt-auth
+// https://github.com/tpm2-software/tpm2-tools/wiki/Duplicating-Objects
+//
+//  Tpm (string): The device Handle for the TPM (eg. "/dev/tpm0")
+//  Email (string): The service account to get the token for.
+//  TargetAudience (string): The audience the returned ID token is valid for.
+//  TpmHandle (uint32): The persistent Handle representing the sealed keypair.
+//      This must be set prior to using this library.
+//  KeyId (string): (optional) The private KeyID for the service account key saved to the TPM.
+//      Find the keyId associated with the service account by running:
+//      `gcloud iam service-accounts keys list --iam-account=<email>``
+//
+// The returned TokenSource caches and reuses the ID token until it is close
+// to expiry, and keeps the TPM device handle open across refreshes. Call
+// Close() on the returned source (or type-assert to io.Closer) to release
+// it once it is no longer needed.
+func TpmIDTokenSource(tokenConfig TpmIDTokenConfig) (oauth2.TokenSource, error) {
+
+	if tokenConfig.Tpm == "" || tokenConfig.TpmHandle == 0 || tokenConfig.Email == "" || tokenConfig.TargetAudience == "" {
+		return nil, fmt.Errorf("salrashid123/x/oauth2/google: TpmIDTokenConfig.Tpm, TpmIDTokenConfig.TpmHandle, TpmIDTokenConfig.Email and TargetAudience cannot be nil")
+	}
+
+	raw := &tpmIDTokenSource{
+		refreshMutex:   &sync.Mutex{},
+		email:          tokenConfig.Email,
+		targetAudience: tokenConfig.TargetAudience,
+		httpClient:     httpClientOrDefault(tokenConfig.HTTPClient),
+		tpm:            tokenConfig.Tpm,
+		tpmHandle:      tpmutil.Handle(tokenConfig.TpmHandle),
+		keyId:          tokenConfig.KeyId,
+	}
+
+	return newTpmCachingTokenSource(raw, raw, tokenConfig.EarlyTokenExpiry), nil
+}
+
+// Close releases the TPM device handle kept open across token refreshes.
+func (ts *tpmIDTokenSource) Close() error {
+	ts.refreshMutex.Lock()
+	defer ts.refreshMutex.Unlock()
+	return closeTPMLocked(&ts.rwc)
+}
+
+// signAssertionLocked opens the TPM (if needed) and signs the assertion
+// under refreshMutex, then releases the lock before returning so the
+// network round-trip that follows doesn't block other concurrent callers.
+func (ts *tpmIDTokenSource) signAssertionLocked(iat, exp time.Time) (string, error) {
+	ts.refreshMutex.Lock()
+	defer ts.refreshMutex.Unlock()
+
+	if err := openTPMLocked(ts.tpm, &ts.rwc); err != nil {
+		return "", err
+	}
+
+	return signTpmJWT(ts.rwc, ts.tpmHandle, ts.keyId, &jws.ClaimSet{
+		Iss: ts.email,
+		Sub: ts.email,
+		Aud: googleTokenURL,
+		Iat: iat.Unix(),
+		Exp: exp.Unix(),
+		PrivateClaims: map[string]interface{}{
+			"target_audience": ts.targetAudience,
+		},
+	})
+}
+
+func (ts *tpmIDTokenSource) Token() (*oauth2.Token, error) {
+	iat := time.Now()
+	exp := iat.Add(time.Hour)
+
+	assertion, err := ts.signAssertionLocked(iat, exp)
+	if err != nil {
+		return nil, fmt.Errorf("google: unable to sign TPM JWT assertion: %v", err)
+	}
+
+	v := url.Values{}
+	v.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+	v.Set("assertion", assertion)
+
+	resp, err := postForm(ts.httpClient, googleTokenURL, v)
+	if err != nil {
+		return nil, fmt.Errorf("google: unable to exchange TPM JWT assertion for an ID token: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("google: unable to read token endpoint response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("google: token endpoint returned %v: %s", resp.StatusCode, body)
+	}
+
+	var tokenRes struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &tokenRes); err != nil {
+		return nil, fmt.Errorf("google: unable to unmarshal token endpoint response: %v", err)
+	}
+
+	return &oauth2.Token{
+		AccessToken: tokenRes.IDToken,
+		TokenType:   "Bearer",
+		Expiry:      exp,
+	}, nil
+}
@@ -0,0 +1,242 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package google
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-tpm/tpmutil"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/jws"
+)
+
+const (
+	stsTokenURL               = "https://sts.googleapis.com/v1/token"
+	iamCredentialsTokenURLFmt = "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/%s:generateAccessToken"
+)
+
+// TpmWorkloadIdentityConfig parameters used to mint a Google Workload
+// Identity Federation access token backed by a TPM-sealed signing key.
+type TpmWorkloadIdentityConfig struct {
+	Tpm, Email string
+	TpmHandle  uint32
+	KeyId      string
+
+	// Audience is the full resource name of the workload identity pool
+	// provider, e.g.
+	// "//iam.googleapis.com/projects/<number>/locations/global/workloadIdentityPools/<pool>/providers/<provider>".
+	Audience string
+
+	// TargetPrincipal is the email of the service account to impersonate
+	// after the federated token is obtained.
+	TargetPrincipal string
+
+	// Scopes is the list of scopes requested for the final impersonated
+	// access token. Defaults to the cloud-platform scope if empty.
+	Scopes []string
+
+	// EarlyTokenExpiry is how long before expiry a cached token is
+	// re-signed and refreshed. Defaults to 60s.
+	EarlyTokenExpiry time.Duration
+
+	// HTTPClient is used for the STS and IAM credentials token exchanges.
+	// If nil, a client with a default 30s timeout is used.
+	HTTPClient *http.Client
+}
+
+type tpmWorkloadIdentitySource struct {
+	refreshMutex              *sync.Mutex
+	tpm, email                string
+	audience, targetPrincipal string
+	scopes                    []string
+	httpClient                *http.Client
+
+	rwc       io.ReadWriteCloser
+	tpmHandle tpmutil.Handle
+	keyId     string
+}
+
+// TpmWorkloadIdentitySource returns a TokenSource that exchanges a TPM-signed
+// subject token for a Google Workload Identity Federation access token, then
+// impersonates TargetPrincipal to produce the final access token. Unlike the
+// conventional flow, which reads a credential configuration file pointing to
+// a subject token file or executable, the subject token JWT here is signed
+// entirely within the TPM, so no service-account key material ever exists on
+// disk.
+//
+// https://cloud.google.com/iam/docs/workload-identity-federation
+// https://cloud.google.com/iam/docs/reference/sts/rest/v1/TopLevel/token
+// https://cloud.google.com/iam/docs/reference/credentials/rest/v1/projects.serviceAccounts/generateAccessToken
+//
+//  Tpm (string): The device Handle for the TPM (eg. "/dev/tpm0")
+//  Email (string): The identity used as iss/sub in the signed subject token.
+//  Audience (string): The workload identity pool provider resource name.
+//  TargetPrincipal (string): The service account email to impersonate.
+//  Scopes ([]string): The scopes to request for the impersonated access token.
+//  TpmHandle (uint32): The persistent Handle representing the sealed keypair.
+//  KeyId (string): (optional) The private KeyID of the signing key.
+//
+// The returned TokenSource caches and reuses the impersonated access token
+// until it is close to expiry, and keeps the TPM device handle open across
+// refreshes. Call Close() on the returned source (or type-assert to
+// io.Closer) to release it once it is no longer needed.
+func TpmWorkloadIdentitySource(config TpmWorkloadIdentityConfig) (oauth2.TokenSource, error) {
+
+	if config.Tpm == "" || config.TpmHandle == 0 || config.Email == "" || config.Audience == "" || config.TargetPrincipal == "" {
+		return nil, fmt.Errorf("salrashid123/x/oauth2/google: TpmWorkloadIdentityConfig.Tpm, TpmHandle, Email, Audience and TargetPrincipal cannot be nil")
+	}
+
+	scopes := config.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"https://www.googleapis.com/auth/cloud-platform"}
+	}
+
+	raw := &tpmWorkloadIdentitySource{
+		refreshMutex:    &sync.Mutex{},
+		email:           config.Email,
+		audience:        config.Audience,
+		targetPrincipal: config.TargetPrincipal,
+		scopes:          scopes,
+		httpClient:      httpClientOrDefault(config.HTTPClient),
+		tpm:             config.Tpm,
+		tpmHandle:       tpmutil.Handle(config.TpmHandle),
+		keyId:           config.KeyId,
+	}
+
+	return newTpmCachingTokenSource(raw, raw, config.EarlyTokenExpiry), nil
+}
+
+// Close releases the TPM device handle kept open across token refreshes.
+func (ts *tpmWorkloadIdentitySource) Close() error {
+	ts.refreshMutex.Lock()
+	defer ts.refreshMutex.Unlock()
+	return closeTPMLocked(&ts.rwc)
+}
+
+// signSubjectTokenLocked opens the TPM (if needed) and signs the subject
+// token under refreshMutex, then releases the lock before returning so the
+// network round-trips that follow don't block other concurrent callers.
+func (ts *tpmWorkloadIdentitySource) signSubjectTokenLocked(iat, exp time.Time) (string, error) {
+	ts.refreshMutex.Lock()
+	defer ts.refreshMutex.Unlock()
+
+	if err := openTPMLocked(ts.tpm, &ts.rwc); err != nil {
+		return "", err
+	}
+
+	return signTpmJWT(ts.rwc, ts.tpmHandle, ts.keyId, &jws.ClaimSet{
+		Iss: ts.email,
+		Sub: ts.email,
+		Aud: ts.audience,
+		Iat: iat.Unix(),
+		Exp: exp.Unix(),
+	})
+}
+
+func (ts *tpmWorkloadIdentitySource) Token() (*oauth2.Token, error) {
+	iat := time.Now()
+	exp := iat.Add(time.Hour)
+
+	subjectToken, err := ts.signSubjectTokenLocked(iat, exp)
+	if err != nil {
+		return nil, fmt.Errorf("google: unable to sign TPM subject token: %v", err)
+	}
+
+	federatedToken, err := exchangeSubjectToken(ts.httpClient, ts.audience, subjectToken, ts.scopes)
+	if err != nil {
+		return nil, fmt.Errorf("google: unable to exchange TPM subject token at STS endpoint: %v", err)
+	}
+
+	return generateImpersonatedAccessToken(ts.httpClient, federatedToken, ts.targetPrincipal, ts.scopes)
+}
+
+// exchangeSubjectToken trades a TPM-signed subject token for a Google STS
+// federated access token.
+func exchangeSubjectToken(client *http.Client, audience, subjectToken string, scopes []string) (string, error) {
+	v := url.Values{}
+	v.Set("grant_type", "urn:ietf:params:oauth:grant-type:token-exchange")
+	v.Set("audience", audience)
+	v.Set("scope", strings.Join(scopes, " "))
+	v.Set("requested_token_type", "urn:ietf:params:oauth:token-type:access_token")
+	v.Set("subject_token_type", "urn:ietf:params:oauth:token-type:jwt")
+	v.Set("subject_token", subjectToken)
+
+	resp, err := postForm(client, stsTokenURL, v)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("sts endpoint returned %v: %s", resp.StatusCode, body)
+	}
+
+	var stsRes struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(body, &stsRes); err != nil {
+		return "", err
+	}
+	return stsRes.AccessToken, nil
+}
+
+// generateImpersonatedAccessToken calls the IAM credentials API to
+// impersonate targetPrincipal using the supplied federated access token.
+func generateImpersonatedAccessToken(client *http.Client, federatedToken, targetPrincipal string, scopes []string) (*oauth2.Token, error) {
+	reqBody, err := json.Marshal(struct {
+		Scope []string `json:"scope"`
+	}{Scope: scopes})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", fmt.Sprintf(iamCredentialsTokenURLFmt, targetPrincipal), bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+federatedToken)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("iamcredentials endpoint returned %v: %s", resp.StatusCode, body)
+	}
+
+	var iamRes struct {
+		AccessToken string    `json:"accessToken"`
+		ExpireTime  time.Time `json:"expireTime"`
+	}
+	if err := json.Unmarshal(body, &iamRes); err != nil {
+		return nil, err
+	}
+
+	return &oauth2.Token{
+		AccessToken: iamRes.AccessToken,
+		TokenType:   "Bearer",
+		Expiry:      iamRes.ExpireTime,
+	}, nil
+}